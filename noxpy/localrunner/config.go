@@ -0,0 +1,289 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config is the typed form of the TOML file loaded via -config. It mirrors
+// the flag set laid out in main(): each section overlays the flags it
+// covers, and a [profiles.<name>] table can further overlay any section for
+// a single named preset (selected with -profile).
+//
+// Precedence, highest to lowest: explicit CLI flags, -config file values
+// (profile overlay wins over its section's base value), env vars / runtime
+// auto-detection (NOX_PREFETCH, NOX_NUM_THREADS, autoWarmupFlags).
+type Config struct {
+	Model    ModelConfig              `toml:"model"`
+	Sampling SamplingConfig           `toml:"sampling"`
+	Runtime  RuntimeConfig            `toml:"runtime"`
+	Serve    ServeConfig              `toml:"serve"`
+	Profiles map[string]ProfileConfig `toml:"profiles"`
+}
+
+// ModelConfig covers [model].
+type ModelConfig struct {
+	Path string `toml:"path"`
+}
+
+// SamplingConfig covers [sampling]. Fields are pointers so an absent TOML
+// key is distinguishable from an explicit zero value.
+type SamplingConfig struct {
+	Temp          *float64 `toml:"temp"`
+	TopP          *float64 `toml:"top_p"`
+	TopK          *int     `toml:"top_k"`
+	RepeatLastN   *int     `toml:"repeat_last_n"`
+	RepeatPenalty *float64 `toml:"repeat_penalty"`
+	Fast          *bool    `toml:"fast"`
+}
+
+// RuntimeConfig covers [runtime].
+type RuntimeConfig struct {
+	Ctx      *int  `toml:"ctx"`
+	Batch    *int  `toml:"batch"`
+	Prepack  *bool `toml:"prepack"`
+	Prefetch *bool `toml:"prefetch"`
+	KVWindow *int  `toml:"kv_window"`
+}
+
+// ServeConfig covers [serve].
+type ServeConfig struct {
+	Serve       *bool `toml:"serve"`
+	ServeRS     *bool `toml:"serve_rs"`
+	KeepCache   *bool `toml:"keep_cache"`
+	Append      *bool `toml:"append"`
+	InputOnly   *bool `toml:"input_only"`
+	StreamBytes *int  `toml:"stream_bytes"`
+}
+
+// ProfileConfig is a named overlay under [profiles.<name>]; any section left
+// zero-value here falls through to the top-level section it overlays.
+type ProfileConfig struct {
+	Model    ModelConfig    `toml:"model"`
+	Sampling SamplingConfig `toml:"sampling"`
+	Runtime  RuntimeConfig  `toml:"runtime"`
+	Serve    ServeConfig    `toml:"serve"`
+}
+
+// loadConfig decodes a TOML config file.
+func loadConfig(path string) (*Config, error) {
+	var cfg Config
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return nil, fmt.Errorf("config: decode %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// withProfile returns the effective config after overlaying the named
+// profile (if any) on top of cfg's base sections. An empty name is a no-op.
+func (c *Config) withProfile(name string) (*Config, error) {
+	if name == "" {
+		return c, nil
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("config: unknown profile %q", name)
+	}
+	effective := *c
+	if profile.Model.Path != "" {
+		effective.Model.Path = profile.Model.Path
+	}
+	effective.Sampling = overlaySampling(c.Sampling, profile.Sampling)
+	effective.Runtime = overlayRuntime(c.Runtime, profile.Runtime)
+	effective.Serve = overlayServe(c.Serve, profile.Serve)
+	return &effective, nil
+}
+
+func overlaySampling(base, over SamplingConfig) SamplingConfig {
+	if over.Temp != nil {
+		base.Temp = over.Temp
+	}
+	if over.TopP != nil {
+		base.TopP = over.TopP
+	}
+	if over.TopK != nil {
+		base.TopK = over.TopK
+	}
+	if over.RepeatLastN != nil {
+		base.RepeatLastN = over.RepeatLastN
+	}
+	if over.RepeatPenalty != nil {
+		base.RepeatPenalty = over.RepeatPenalty
+	}
+	if over.Fast != nil {
+		base.Fast = over.Fast
+	}
+	return base
+}
+
+func overlayRuntime(base, over RuntimeConfig) RuntimeConfig {
+	if over.Ctx != nil {
+		base.Ctx = over.Ctx
+	}
+	if over.Batch != nil {
+		base.Batch = over.Batch
+	}
+	if over.Prepack != nil {
+		base.Prepack = over.Prepack
+	}
+	if over.Prefetch != nil {
+		base.Prefetch = over.Prefetch
+	}
+	if over.KVWindow != nil {
+		base.KVWindow = over.KVWindow
+	}
+	return base
+}
+
+func overlayServe(base, over ServeConfig) ServeConfig {
+	if over.Serve != nil {
+		base.Serve = over.Serve
+	}
+	if over.ServeRS != nil {
+		base.ServeRS = over.ServeRS
+	}
+	if over.KeepCache != nil {
+		base.KeepCache = over.KeepCache
+	}
+	if over.Append != nil {
+		base.Append = over.Append
+	}
+	if over.InputOnly != nil {
+		base.InputOnly = over.InputOnly
+	}
+	if over.StreamBytes != nil {
+		base.StreamBytes = over.StreamBytes
+	}
+	return base
+}
+
+// Apply pushes non-absent config values into fs, skipping any flag name
+// present in explicit (flags the user actually passed on the command line
+// always win).
+func (c *Config) Apply(fs *flag.FlagSet, explicit map[string]bool) error {
+	set := func(name string, value interface{}) error {
+		if explicit[name] {
+			return nil
+		}
+		return fs.Set(name, fmt.Sprintf("%v", value))
+	}
+
+	if c.Model.Path != "" {
+		if err := set("model", c.Model.Path); err != nil {
+			return err
+		}
+	}
+	if v := c.Sampling.Temp; v != nil {
+		if err := set("temp", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Sampling.TopP; v != nil {
+		if err := set("top-p", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Sampling.TopK; v != nil {
+		if err := set("top-k", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Sampling.RepeatLastN; v != nil {
+		if err := set("repeat-last-n", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Sampling.RepeatPenalty; v != nil {
+		if err := set("repeat-penalty", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Sampling.Fast; v != nil {
+		if err := set("fast", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Runtime.Ctx; v != nil {
+		if err := set("ctx", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Runtime.Batch; v != nil {
+		if err := set("batch", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Runtime.Prepack; v != nil {
+		if err := set("prepack", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Runtime.Prefetch; v != nil {
+		if err := set("prefetch", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Runtime.KVWindow; v != nil {
+		if err := set("kv-window", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Serve.Serve; v != nil {
+		if err := set("serve", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Serve.ServeRS; v != nil {
+		if err := set("serve-rs", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Serve.KeepCache; v != nil {
+		if err := set("keep-cache", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Serve.Append; v != nil {
+		if err := set("append", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Serve.InputOnly; v != nil {
+		if err := set("input-only", *v); err != nil {
+			return err
+		}
+	}
+	if v := c.Serve.StreamBytes; v != nil {
+		if err := set("stream-bytes", *v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// explicitFlags returns the set of flag names the user actually passed on
+// the command line, as opposed to ones merely holding their default value.
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// dumpConfig prints the effective, fully-merged flag values to stderr in
+// TOML form so users can see what actually ran.
+func dumpConfig(fs *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "# effective config (-dump-config)")
+	enc := toml.NewEncoder(os.Stderr)
+	snapshot := map[string]interface{}{}
+	fs.VisitAll(func(f *flag.Flag) {
+		snapshot[f.Name] = f.Value.String()
+	})
+	if err := enc.Encode(snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "dump-config: %v\n", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func float64Ptr(v float64) *float64 { return &v }
+func intPtr(v int) *int             { return &v }
+func boolPtr(v bool) *bool          { return &v }
+
+func TestConfigWithProfileOverlaysOnlySetFields(t *testing.T) {
+	cfg := &Config{
+		Sampling: SamplingConfig{Temp: float64Ptr(0.6), TopK: intPtr(40)},
+		Profiles: map[string]ProfileConfig{
+			"chat-fast": {
+				Sampling: SamplingConfig{Temp: float64Ptr(0.0)},
+			},
+		},
+	}
+
+	effective, err := cfg.withProfile("chat-fast")
+	if err != nil {
+		t.Fatalf("withProfile: %v", err)
+	}
+	if got := *effective.Sampling.Temp; got != 0.0 {
+		t.Fatalf("profile should override temp, got %v", got)
+	}
+	if got := *effective.Sampling.TopK; got != 40 {
+		t.Fatalf("profile should leave top_k untouched, got %v", got)
+	}
+}
+
+func TestConfigWithProfileUnknownName(t *testing.T) {
+	cfg := &Config{}
+	if _, err := cfg.withProfile("does-not-exist"); err == nil {
+		t.Fatal("expected an error for an unknown profile name")
+	}
+}
+
+func TestConfigWithProfileEmptyNameIsNoop(t *testing.T) {
+	cfg := &Config{Sampling: SamplingConfig{Temp: float64Ptr(0.6)}}
+	effective, err := cfg.withProfile("")
+	if err != nil {
+		t.Fatalf("withProfile: %v", err)
+	}
+	if effective != cfg {
+		t.Fatal("empty profile name should return cfg unchanged")
+	}
+}
+
+func TestConfigApplyExplicitFlagWins(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	temp := fs.Float64("temp", 0.6, "")
+	topK := fs.Int("top-k", 40, "")
+	if err := fs.Parse([]string{"-temp=0.9"}); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	explicit := explicitFlags(fs)
+
+	cfg := &Config{Sampling: SamplingConfig{Temp: float64Ptr(0.1), TopK: intPtr(7)}}
+	if err := cfg.Apply(fs, explicit); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if *temp != 0.9 {
+		t.Fatalf("explicit -temp should win over config file, got %v", *temp)
+	}
+	if *topK != 7 {
+		t.Fatalf("config file value should apply to a flag not passed explicitly, got %v", *topK)
+	}
+}
+
+func TestOverlayServeOnlyOverridesSetFields(t *testing.T) {
+	base := ServeConfig{KeepCache: boolPtr(true), Append: boolPtr(false)}
+	over := ServeConfig{Append: boolPtr(true)}
+	merged := overlayServe(base, over)
+	if merged.KeepCache == nil || !*merged.KeepCache {
+		t.Fatal("base KeepCache should survive an overlay that doesn't set it")
+	}
+	if merged.Append == nil || !*merged.Append {
+		t.Fatal("overlay should override Append")
+	}
+}
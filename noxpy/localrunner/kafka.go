@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// Prompt is a single unit of work pulled from a promptSource. Key, when set,
+// is propagated onto whatever the resultSink emits for routing purposes
+// (e.g. a Kafka partition key).
+type Prompt struct {
+	Text      string
+	Key       []byte
+	Headers   []sarama.RecordHeader
+	SessionID string
+}
+
+// kafkaSessionHeader is the Kafka message header carrying a prompt's
+// session id, consulted when -serve multiplexes conversations (see
+// sessionTable).
+const kafkaSessionHeader = "session-id"
+
+// tokenWriter is the subset of *streamWriter that runTokens needs to emit
+// generated text. stdout serving and Kafka serving implement it differently:
+// stdout buffers into the process's stdout stream, Kafka buffers into
+// outgoing ProducerMessages.
+type tokenWriter interface {
+	WriteString(piece string) error
+	Flush() error
+}
+
+// resultSink owns the lifecycle of a tokenWriter across one prompt's
+// generation: NewWriter is called before runTokens, Finish after.
+type resultSink interface {
+	NewWriter(p Prompt) tokenWriter
+	Finish(w tokenWriter, rawOut bool) error
+	Close() error
+}
+
+// stdoutResultSink reproduces the historical -serve behaviour: write tokens
+// to stdout through the shared streamWriter, then emit the end-of-response
+// marker once generation finishes.
+type stdoutResultSink struct {
+	streamer  *streamWriter
+	endMarker string
+}
+
+func newStdoutResultSink(streamer *streamWriter, endMarker string) *stdoutResultSink {
+	return &stdoutResultSink{streamer: streamer, endMarker: endMarker}
+}
+
+func (s *stdoutResultSink) NewWriter(_ Prompt) tokenWriter {
+	return s.streamer
+}
+
+func (s *stdoutResultSink) Finish(_ tokenWriter, rawOut bool) error {
+	if err := s.streamer.Flush(); err != nil {
+		return err
+	}
+	if !rawOut {
+		fmt.Fprintln(s.streamer.writer)
+	}
+	fmt.Fprint(s.streamer.writer, s.endMarker)
+	return s.streamer.writer.Flush()
+}
+
+func (s *stdoutResultSink) Close() error { return nil }
+
+// kafkaPromptSource consumes prompts from a Kafka topic via a consumer
+// group, so multiple noctics processes can share the work of a topic.
+type kafkaPromptSource struct {
+	client        sarama.ConsumerGroup
+	topic         string
+	passHeaders   bool
+	prompts       chan Prompt
+	errs          chan error
+	cancel        context.CancelFunc
+	consumeDoneWg sync.WaitGroup
+}
+
+func newKafkaPromptSource(brokers []string, topic, groupID string, passHeaders bool) (*kafkaPromptSource, error) {
+	cfg := sarama.NewConfig()
+	cfg.Consumer.Return.Errors = true
+	cfg.Consumer.Offsets.Initial = sarama.OffsetNewest
+
+	group, err := sarama.NewConsumerGroup(brokers, groupID, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: create consumer group: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &kafkaPromptSource{
+		client:      group,
+		topic:       topic,
+		passHeaders: passHeaders,
+		prompts:     make(chan Prompt, 16),
+		errs:        make(chan error, 1),
+		cancel:      cancel,
+	}
+
+	src.consumeDoneWg.Add(1)
+	go func() {
+		defer src.consumeDoneWg.Done()
+		for {
+			if err := group.Consume(ctx, []string{topic}, src); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				select {
+				case src.errs <- fmt.Errorf("kafka: consume: %w", err):
+				default:
+				}
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for err := range group.Errors() {
+			fmt.Fprintf(os.Stderr, "kafka consumer error: %v\n", err)
+		}
+	}()
+
+	return src, nil
+}
+
+// Setup and Cleanup satisfy sarama.ConsumerGroupHandler.
+func (s *kafkaPromptSource) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (s *kafkaPromptSource) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+// ConsumeClaim satisfies sarama.ConsumerGroupHandler; it feeds consumed
+// messages into the Prompt channel that Next drains.
+func (s *kafkaPromptSource) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		headers := make([]sarama.RecordHeader, 0, len(msg.Headers))
+		var sessionID string
+		for _, h := range msg.Headers {
+			headers = append(headers, *h)
+			if string(h.Key) == kafkaSessionHeader {
+				sessionID = string(h.Value)
+			}
+			if s.passHeaders {
+				fmt.Fprintf(os.Stderr, "%skafka-header|%s|%s\n", metricsPrefix, h.Key, h.Value)
+			}
+		}
+		s.prompts <- Prompt{Text: string(msg.Value), Key: msg.Key, Headers: headers, SessionID: sessionID}
+		sess.MarkMessage(msg, "")
+	}
+	return nil
+}
+
+// Next blocks until a prompt is available, the consumer group fails, or the
+// source is closed.
+func (s *kafkaPromptSource) Next() (Prompt, error) {
+	select {
+	case p, ok := <-s.prompts:
+		if !ok {
+			return Prompt{}, io.EOF
+		}
+		return p, nil
+	case err := <-s.errs:
+		return Prompt{}, err
+	}
+}
+
+func (s *kafkaPromptSource) Close() error {
+	s.cancel()
+	s.consumeDoneWg.Wait()
+	return s.client.Close()
+}
+
+// kafkaTokenWriter buffers generated text and publishes it to Kafka either
+// once per completion (flushBytes == 0) or once per flushBytes buffered
+// bytes. The latter mirrors streamWriter; at 0, where streamWriter flushes
+// every token, this emits a single message per completion instead.
+type kafkaTokenWriter struct {
+	producer   sarama.SyncProducer
+	topic      string
+	key        []byte
+	headers    []sarama.RecordHeader
+	flushBytes int
+	buffer     []byte
+}
+
+func (w *kafkaTokenWriter) WriteString(piece string) error {
+	w.buffer = append(w.buffer, piece...)
+	if w.flushBytes > 0 && len(w.buffer) >= w.flushBytes {
+		return w.emit()
+	}
+	return nil
+}
+
+func (w *kafkaTokenWriter) Flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	return w.emit()
+}
+
+func (w *kafkaTokenWriter) emit() error {
+	msg := &sarama.ProducerMessage{
+		Topic: w.topic,
+		Value: sarama.ByteEncoder(w.buffer),
+	}
+	if len(w.key) > 0 {
+		msg.Key = sarama.ByteEncoder(w.key)
+	}
+	if len(w.headers) > 0 {
+		msg.Headers = w.headers
+	}
+	_, _, err := w.producer.SendMessage(msg)
+	w.buffer = w.buffer[:0]
+	return err
+}
+
+// kafkaResultSink produces completions onto a Kafka topic, one
+// kafkaTokenWriter per prompt so each completion keeps the originating
+// message's key for routing.
+type kafkaResultSink struct {
+	producer   sarama.SyncProducer
+	topic      string
+	flushBytes int
+}
+
+func newKafkaResultSink(brokers []string, topic string, flushBytes int) (*kafkaResultSink, error) {
+	cfg := sarama.NewConfig()
+	cfg.Producer.RequiredAcks = sarama.WaitForLocal
+	cfg.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(brokers, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: create producer: %w", err)
+	}
+	return &kafkaResultSink{producer: producer, topic: topic, flushBytes: flushBytes}, nil
+}
+
+func (s *kafkaResultSink) NewWriter(p Prompt) tokenWriter {
+	return &kafkaTokenWriter{
+		producer:   s.producer,
+		topic:      s.topic,
+		key:        p.Key,
+		headers:    p.Headers,
+		flushBytes: s.flushBytes,
+	}
+}
+
+func (s *kafkaResultSink) Finish(w tokenWriter, _ bool) error {
+	return w.Flush()
+}
+
+func (s *kafkaResultSink) Close() error {
+	return s.producer.Close()
+}
+
+func parseKafkaBrokers(brokers string) []string {
+	var out []string
+	for _, b := range strings.Split(brokers, ",") {
+		b = strings.TrimSpace(b)
+		if b != "" {
+			out = append(out, b)
+		}
+	}
+	return out
+}
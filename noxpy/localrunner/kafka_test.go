@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKafkaBrokers(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"localhost:9092", []string{"localhost:9092"}},
+		{"a:9092,b:9092", []string{"a:9092", "b:9092"}},
+		{" a:9092 , , b:9092 ", []string{"a:9092", "b:9092"}},
+	}
+	for _, c := range cases {
+		if got := parseKafkaBrokers(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseKafkaBrokers(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestSplitSessionHeaderLineMode(t *testing.T) {
+	cases := []struct {
+		raw      string
+		wantID   string
+		wantText string
+	}{
+		{"hello there", "", "hello there"},
+		{"SID:abc hello there", "abc", "hello there"},
+		{"SID:abc", "", "SID:abc"}, // no space after the id: not a valid header
+	}
+	for _, c := range cases {
+		id, text := splitSessionHeader(c.raw, false)
+		if id != c.wantID || text != c.wantText {
+			t.Errorf("splitSessionHeader(%q, false) = (%q, %q), want (%q, %q)", c.raw, id, text, c.wantID, c.wantText)
+		}
+	}
+}
+
+func TestSplitSessionHeaderRSMode(t *testing.T) {
+	raw := "abc" + string([]byte{0x1f}) + "hello there"
+	id, text := splitSessionHeader(raw, true)
+	if id != "abc" || text != "hello there" {
+		t.Fatalf("splitSessionHeader(rs mode) = (%q, %q), want (%q, %q)", id, text, "abc", "hello there")
+	}
+
+	id, text = splitSessionHeader("no header here", true)
+	if id != "" || text != "no header here" {
+		t.Fatalf("splitSessionHeader(rs mode, no separator) = (%q, %q), want (%q, %q)", id, text, "", "no header here")
+	}
+}
@@ -15,6 +15,8 @@ import (
 
 	"github.com/ollama/ollama/llama"
 	"github.com/ollama/ollama/ml"
+
+	"github.com/Rei-ath/noctics/pkg/threshold"
 )
 
 type runStats struct {
@@ -22,6 +24,7 @@ type runStats struct {
 	GeneratedTokens int
 	Prefill         time.Duration
 	Generate        time.Duration
+	StopReason      string
 }
 
 const metricsPrefix = "NR|"
@@ -94,38 +97,72 @@ func (s *streamWriter) Flush() error {
 
 func main() {
 	var (
-		modelPath  = flag.String("model", "", "Path to the GGUF model (defaults to assets/models/nox.gguf)")
-		maxTokens  = flag.Int("max-tokens", 128, "Maximum tokens to generate")
-		ctxLength  = flag.Int("ctx", 1024, "Context length")
-		batchSize  = flag.Int("batch", 32, "Batch size")
-		temp       = flag.Float64("temp", 0.6, "Temperature")
-		topP       = flag.Float64("top-p", 0.9, "Top-p")
-		topK       = flag.Int("top-k", 40, "Top-k")
-		repeatLast = flag.Int("repeat-last-n", 64, "Repetition window")
-		repeatPen  = flag.Float64("repeat-penalty", 1.05, "Repetition penalty")
-		fast       = flag.Bool("fast", false, "Fast/greedy sampling preset for lower latency")
-		rawOut     = flag.Bool("raw", false, "Emit only generated tokens (no prefix/newlines)")
-		prepack    = &triBool{}
-		prefetch   = &triBool{}
-		streamBuf  = flag.Int("stream-bytes", 0, "Buffer N bytes before flushing output (0 = flush each token)")
-		kvWindow   = flag.Int("kv-window", 0, "Sliding KV window size (0 = disabled)")
-		metrics    = flag.Bool("metrics", false, "Emit per-token logit metrics to stderr (NR|token|max|second|margin)")
-		serve      = flag.Bool("serve", false, "Serve prompts from stdin (one per line)")
-		serveRS    = flag.Bool("serve-rs", false, "Use ASCII record separator (0x1e) as prompt delimiter")
-		keepCache  = flag.Bool("keep-cache", false, "Reuse KV cache between prompts when prefix matches")
-		appendOnly = flag.Bool("append", false, "Append prompts onto existing cache (no reset)")
-		inputOnly  = flag.Bool("input-only", false, "Keep KV cache aligned to prompt only (do not append generated tokens)")
-		bench      = flag.Bool("bench", false, "Print benchmark stats to stderr")
-		stateSave  = flag.String("state-save", "", "Save KV/cache state to a session file after each prompt")
-		stateLoad  = flag.String("state-load", "", "Load KV/cache state from a session file before running")
-		chatMode   = flag.Bool("chat", false, "Wrap prompts in a simple ChatML/Qwen-style chat format")
-		systemMsg  = flag.String("system", "", "System prompt for -chat (default: minimal assistant)")
-		cotMode    = flag.Bool("cot", false, "For -chat: request chain-of-thought style reasoning (more tokens, slower end-to-end)")
+		modelPath         = flag.String("model", "", "Path to the GGUF model (defaults to assets/models/nox.gguf)")
+		maxTokens         = flag.Int("max-tokens", 128, "Maximum tokens to generate")
+		ctxLength         = flag.Int("ctx", 1024, "Context length")
+		batchSize         = flag.Int("batch", 32, "Batch size")
+		temp              = flag.Float64("temp", 0.6, "Temperature")
+		topP              = flag.Float64("top-p", 0.9, "Top-p")
+		topK              = flag.Int("top-k", 40, "Top-k")
+		repeatLast        = flag.Int("repeat-last-n", 64, "Repetition window")
+		repeatPen         = flag.Float64("repeat-penalty", 1.05, "Repetition penalty")
+		fast              = flag.Bool("fast", false, "Fast/greedy sampling preset for lower latency")
+		rawOut            = flag.Bool("raw", false, "Emit only generated tokens (no prefix/newlines)")
+		prepack           = &triBool{}
+		prefetch          = &triBool{}
+		streamBuf         = flag.Int("stream-bytes", 0, "Buffer N bytes before flushing output (0 = flush each token)")
+		kvWindow          = flag.Int("kv-window", 0, "Sliding KV window size (0 = disabled)")
+		metrics           = flag.Bool("metrics", false, "Emit per-token logit metrics to stderr (NR|token|max|second|margin)")
+		serve             = flag.Bool("serve", false, "Serve prompts from stdin (one per line)")
+		serveRS           = flag.Bool("serve-rs", false, "Use ASCII record separator (0x1e) as prompt delimiter")
+		keepCache         = flag.Bool("keep-cache", false, "Reuse KV cache between prompts when prefix matches")
+		appendOnly        = flag.Bool("append", false, "Append prompts onto existing cache (no reset)")
+		inputOnly         = flag.Bool("input-only", false, "Keep KV cache aligned to prompt only (do not append generated tokens)")
+		bench             = flag.Bool("bench", false, "Print benchmark stats to stderr")
+		stateSave         = flag.String("state-save", "", "Save KV/cache state to a session file after each prompt")
+		stateLoad         = flag.String("state-load", "", "Load KV/cache state from a session file before running")
+		stateStore        = flag.String("state-store", "", "Pluggable -serve session store: a directory (file backend) or redis://host:port/db?prefix=nox: (Redis backend)")
+		maxSessions       = flag.Int("max-sessions", 8, "Maximum concurrent multiplexed sessions in -serve mode (sizes the KV cache sequence capacity; oldest session is evicted beyond this)")
+		thresholdRules    = flag.String("threshold-rules", "", "Path to a TOML file of confidence-threshold rules evaluated against logit margin/entropy each token")
+		chatMode          = flag.Bool("chat", false, "Wrap prompts in a simple ChatML/Qwen-style chat format")
+		systemMsg         = flag.String("system", "", "System prompt for -chat (default: minimal assistant)")
+		cotMode           = flag.Bool("cot", false, "For -chat: request chain-of-thought style reasoning (more tokens, slower end-to-end)")
+		kafkaOn           = flag.Bool("kafka", false, "Serve prompts from a Kafka topic instead of stdin (requires -serve)")
+		kafkaBrokers      = flag.String("kafka-brokers", "", "Comma-separated Kafka broker addresses")
+		kafkaConsumeTopic = flag.String("kafka-consume-topic", "", "Kafka topic to consume prompts from")
+		kafkaProduceTopic = flag.String("kafka-produce-topic", "", "Kafka topic to publish completions to")
+		kafkaGroupID      = flag.String("kafka-group-id", "noctics", "Kafka consumer group id")
+		kafkaHeaders      = flag.Bool("kafka-headers", false, "Pass consumed message headers through to stderr metrics")
+		configPath        = flag.String("config", "", "Path to a TOML config file (flags still win over file values)")
+		profile           = flag.String("profile", "", "Named [profiles.<name>] overlay to apply from -config")
+		dumpConfigFlag    = flag.Bool("dump-config", false, "Print the effective merged config to stderr and continue")
 	)
 	flag.Var(prepack, "prepack", "Preload+lock model weights in RAM (mlock) for faster inference")
 	flag.Var(prefetch, "prefetch", "Warm OS cache by sequentially reading the model file")
 	flag.Parse()
 
+	if *configPath != "" {
+		explicit := explicitFlags(flag.CommandLine)
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		cfg, err = cfg.withProfile(*profile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if err := cfg.Apply(flag.CommandLine, explicit); err != nil {
+			fmt.Fprintf(os.Stderr, "config: apply: %v\n", err)
+			os.Exit(1)
+		}
+	} else if *profile != "" {
+		fmt.Fprintln(os.Stderr, "-profile has no effect without -config")
+	}
+	if *kafkaOn && !*serve {
+		fmt.Fprintln(os.Stderr, "-kafka has no effect without -serve")
+	}
 	if *fast {
 		*temp = 0
 		*topP = 1
@@ -134,6 +171,10 @@ func main() {
 		*repeatPen = 1.0
 	}
 
+	if *dumpConfigFlag {
+		dumpConfig(flag.CommandLine)
+	}
+
 	var prompt string
 	if !*serve {
 		prompt = strings.TrimSpace(strings.Join(flag.Args(), " "))
@@ -205,7 +246,14 @@ func main() {
 	}
 	defer llama.FreeModel(model)
 
-	ctxParams := llama.NewContextParams(*ctxLength, *batchSize, 1, threads, ml.FlashAttentionAuto, "")
+	// -max-sessions only matters for multiplexed -serve sessions; a plain
+	// one-shot invocation keeps the pre-multiplexing single-sequence
+	// capacity instead of paying for KV cache it will never use.
+	seqCap := 1
+	if *serve {
+		seqCap = *maxSessions
+	}
+	ctxParams := llama.NewContextParams(*ctxLength, *batchSize, seqCap, threads, ml.FlashAttentionAuto, "")
 	ctx, err := llama.NewContextWithModel(model, ctxParams)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to create context: %v\n", err)
@@ -221,19 +269,29 @@ func main() {
 		}
 	}
 
-	sampler, err := llama.NewSamplingContext(model, llama.SamplingParams{
+	samplingParams := llama.SamplingParams{
 		TopK:          *topK,
 		TopP:          float32(*topP),
 		Temp:          float32(*temp),
 		RepeatLastN:   *repeatLast,
 		PenaltyRepeat: float32(*repeatPen),
-	})
+	}
+	sampler, err := llama.NewSamplingContext(model, samplingParams)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to create sampler: %v\n", err)
 		os.Exit(1)
 	}
 
-	batch, err := llama.NewBatch(*batchSize, 1, 0)
+	var thresholdCfg *threshold.Config
+	if *thresholdRules != "" {
+		thresholdCfg, err = threshold.LoadConfig(*thresholdRules)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load threshold rules: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	batch, err := llama.NewBatch(*batchSize, 1, seqCap)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to allocate batch: %v\n", err)
 		os.Exit(1)
@@ -252,7 +310,53 @@ func main() {
 		if *chatMode || *cotMode || *systemMsg != "" {
 			fmt.Fprintln(os.Stderr, "note: -chat/-cot/-system are not applied in -serve mode")
 		}
-		if err := serveLoop(ctx, model, sampler, batch, streamer, *maxTokens, *rawOut, *serveRS, keepFlag, appendFlag, *inputOnly, *stateSave, loadedTokens, *kvWindow, *metrics); err != nil {
+
+		var source promptSource
+		var sink resultSink
+		if *kafkaOn {
+			brokers := parseKafkaBrokers(*kafkaBrokers)
+			if len(brokers) == 0 || *kafkaConsumeTopic == "" || *kafkaProduceTopic == "" {
+				fmt.Fprintln(os.Stderr, "-kafka requires -kafka-brokers, -kafka-consume-topic and -kafka-produce-topic")
+				os.Exit(1)
+			}
+			kSource, err := newKafkaPromptSource(brokers, *kafkaConsumeTopic, *kafkaGroupID, *kafkaHeaders)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "kafka source init failed: %v\n", err)
+				os.Exit(1)
+			}
+			kSink, err := newKafkaResultSink(brokers, *kafkaProduceTopic, *streamBuf)
+			if err != nil {
+				kSource.Close()
+				fmt.Fprintf(os.Stderr, "kafka sink init failed: %v\n", err)
+				os.Exit(1)
+			}
+			source, sink = kSource, kSink
+		} else {
+			endMarker := "\n<<<NOX_END>>>\n"
+			if *serveRS {
+				endMarker = string([]byte{0x1e})
+			}
+			source = newStdinPromptSource(*serveRS)
+			sink = newStdoutResultSink(streamer, endMarker)
+		}
+		defer source.Close()
+		defer sink.Close()
+
+		store, err := newSessionStore(*stateStore)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "session store init failed: %v\n", err)
+			os.Exit(1)
+		}
+		if store != nil && *stateSave != "" {
+			fmt.Fprintln(os.Stderr, "note: -state-store persists per-session token history; -state-save/-state-load still save and load the whole context alongside it")
+		}
+		sessions := newSessionTable(ctx, store, *maxSessions, !*inputOnly, &sessionState{prevTokens: loadedTokens, cacheGenerated: !*inputOnly})
+
+		// Kafka completions are consumed by other services, not a human at
+		// a terminal: always emit raw tokens so a stray "nox:\n" prefix
+		// doesn't leak into every message payload regardless of -raw.
+		serveRawOut := *rawOut || *kafkaOn
+		if err := serveLoop(ctx, model, sampler, samplingParams, batch, source, sink, sessions, *maxTokens, serveRawOut, keepFlag, appendFlag, *inputOnly, *stateSave, *kvWindow, *metrics, thresholdCfg); err != nil {
 			fmt.Fprintf(os.Stderr, "serve loop failed: %v\n", err)
 			os.Exit(1)
 		}
@@ -270,7 +374,7 @@ func main() {
 		statsPtr = &stats
 	}
 	if len(loadedTokens) == 0 {
-		if err := runPrompt(prompt, ctx, model, sampler, batch, streamer, *maxTokens, *rawOut, statsPtr, *stateSave, *kvWindow, *metrics); err != nil {
+		if err := runPrompt(prompt, ctx, model, sampler, samplingParams, batch, streamer, *maxTokens, *rawOut, statsPtr, *stateSave, *kvWindow, *metrics, thresholdCfg); err != nil {
 			fmt.Fprintf(os.Stderr, "inference failed: %v\n", err)
 			os.Exit(1)
 		}
@@ -287,7 +391,7 @@ func main() {
 				return ctx.StateSaveFile(*stateSave, stateTokens)
 			}
 		}
-		if _, err := runTokens(toks, 0, len(loadedTokens), ctx, model, sampler, batch, streamer, *maxTokens, *rawOut, statsPtr, saveFn, *kvWindow, *metrics); err != nil {
+		if _, err := runTokens(toks, 0, len(loadedTokens), 0, ctx, model, sampler, batch, streamer, *maxTokens, *rawOut, statsPtr, saveFn, *kvWindow, *metrics, newThresholdRuntime(thresholdCfg, model, samplingParams)); err != nil {
 			fmt.Fprintf(os.Stderr, "inference failed: %v\n", err)
 			os.Exit(1)
 		}
@@ -354,32 +458,80 @@ func min(a, b int) int {
 	return b
 }
 
-func serveLoop(ctx *llama.Context, model *llama.Model, sampler *llama.SamplingContext, batch *llama.Batch, writer *streamWriter, maxTokens int, rawOut bool, useRS bool, keepCache bool, appendOnly bool, inputOnly bool, stateSave string, initialTokens []int, kvWindow int, metrics bool) error {
-	reader := bufio.NewReader(os.Stdin)
-	endMarker := "\n<<<NOX_END>>>\n"
+// promptSource yields prompts to serve, one at a time, until the source is
+// exhausted (io.EOF) or fails.
+type promptSource interface {
+	Next() (Prompt, error)
+	Close() error
+}
+
+// stdinPromptSource reads prompts from stdin using the existing -serve /
+// -serve-rs framing (newline- or record-separator-delimited).
+type stdinPromptSource struct {
+	reader *bufio.Reader
+	useRS  bool
+}
+
+func newStdinPromptSource(useRS bool) *stdinPromptSource {
+	return &stdinPromptSource{reader: bufio.NewReader(os.Stdin), useRS: useRS}
+}
+
+func (s *stdinPromptSource) Next() (Prompt, error) {
+	for {
+		text, err := readPrompt(s.reader, s.useRS)
+		if err != nil {
+			return Prompt{}, err
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if text == "exit" || text == "quit" {
+			return Prompt{}, io.EOF
+		}
+		sessionID, text := splitSessionHeader(text, s.useRS)
+		return Prompt{Text: text, SessionID: sessionID}, nil
+	}
+}
+
+// splitSessionHeader pulls an optional session id off the front of a raw
+// prompt so one -serve process can multiplex several conversations (see
+// sessionTable). Under -serve-rs, the session id is a header field
+// terminated by an ASCII unit separator (0x1f); otherwise it is a
+// "SID:<id> " prefix on the prompt's single line.
+func splitSessionHeader(raw string, useRS bool) (sessionID string, text string) {
 	if useRS {
-		endMarker = string([]byte{0x1e})
+		if i := strings.IndexByte(raw, 0x1f); i >= 0 {
+			return raw[:i], raw[i+1:]
+		}
+		return "", raw
 	}
+	if strings.HasPrefix(raw, "SID:") {
+		rest := raw[len("SID:"):]
+		if i := strings.IndexByte(rest, ' '); i >= 0 {
+			return rest[:i], rest[i+1:]
+		}
+	}
+	return "", raw
+}
 
-	prevTokens := append([]int(nil), initialTokens...)
-	cacheGenerated := !inputOnly
+func (s *stdinPromptSource) Close() error { return nil }
 
+func serveLoop(ctx *llama.Context, model *llama.Model, sampler *llama.SamplingContext, baseParams llama.SamplingParams, batch *llama.Batch, source promptSource, sink resultSink, sessions *sessionTable, maxTokens int, rawOut bool, keepCache bool, appendOnly bool, inputOnly bool, stateSave string, kvWindow int, metrics bool, thresholdCfg *threshold.Config) error {
 	for {
-		prompt, err := readPrompt(reader, useRS)
+		p, err := source.Next()
 		if err == io.EOF {
 			return nil
 		}
 		if err != nil {
 			return err
 		}
-		if strings.TrimSpace(prompt) == "" {
+		if strings.TrimSpace(p.Text) == "" {
 			continue
 		}
-		if prompt == "exit" || prompt == "quit" {
-			return nil
-		}
 		start := time.Now()
-		toks, err := tokenizePrompt(model, prompt, appendOnly && len(prevTokens) > 0)
+		sess := sessions.get(p.SessionID)
+		writer := sink.NewWriter(p)
+		toks, err := tokenizePrompt(model, p.Text, appendOnly && len(sess.prevTokens) > 0)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "tokenization failed: %v\n", err)
 			continue
@@ -389,7 +541,7 @@ func serveLoop(ctx *llama.Context, model *llama.Model, sampler *llama.SamplingCo
 		if stateSave != "" {
 			var stateTokens []int
 			if appendOnly {
-				stateTokens = append(append([]int(nil), prevTokens...), toks...)
+				stateTokens = append(append([]int(nil), sess.prevTokens...), toks...)
 			} else {
 				stateTokens = toks
 			}
@@ -397,44 +549,45 @@ func serveLoop(ctx *llama.Context, model *llama.Model, sampler *llama.SamplingCo
 				return ctx.StateSaveFile(stateSave, stateTokens)
 			}
 		}
+		thresh := newThresholdRuntime(thresholdCfg, model, baseParams)
 		if appendOnly {
-			basePos := len(prevTokens)
-			generated, err = runTokens(toks, 0, basePos, ctx, model, sampler, batch, writer, maxTokens, rawOut, nil, saveFn, kvWindow, metrics)
-			prevTokens = append(prevTokens, toks...)
+			basePos := len(sess.prevTokens)
+			generated, err = runTokens(toks, 0, basePos, sess.seqID, ctx, model, sampler, batch, writer, maxTokens, rawOut, nil, saveFn, kvWindow, metrics, thresh)
+			sess.prevTokens = append(sess.prevTokens, toks...)
 		} else if keepCache {
-			common := commonPrefixLen(prevTokens, toks)
+			common := commonPrefixLen(sess.prevTokens, toks)
 			if common == 0 {
-				ctx.KvCacheClear()
-			} else if common < len(prevTokens) {
-				ctx.KvCacheSeqRm(0, common, -1)
+				ctx.KvCacheSeqRm(sess.seqID, 0, -1)
+			} else if common < len(sess.prevTokens) {
+				ctx.KvCacheSeqRm(sess.seqID, common, -1)
 			}
-			generated, err = runTokens(toks, common, 0, ctx, model, sampler, batch, writer, maxTokens, rawOut, nil, saveFn, kvWindow, metrics)
-			prevTokens = toks
+			generated, err = runTokens(toks, common, 0, sess.seqID, ctx, model, sampler, batch, writer, maxTokens, rawOut, nil, saveFn, kvWindow, metrics, thresh)
+			sess.prevTokens = toks
 		} else {
-			generated, err = runTokens(toks, 0, 0, ctx, model, sampler, batch, writer, maxTokens, rawOut, nil, saveFn, kvWindow, metrics)
-			prevTokens = toks
+			generated, err = runTokens(toks, 0, 0, sess.seqID, ctx, model, sampler, batch, writer, maxTokens, rawOut, nil, saveFn, kvWindow, metrics, thresh)
+			sess.prevTokens = toks
 		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "inference failed: %v\n", err)
 		}
-		if len(generated) > 0 && cacheGenerated && (appendOnly || keepCache) {
-			prevTokens = append(prevTokens, generated...)
+		if len(generated) > 0 && sess.cacheGenerated && (appendOnly || keepCache) {
+			sess.prevTokens = append(sess.prevTokens, generated...)
 		} else if inputOnly && (appendOnly || keepCache) {
-			if len(prevTokens) == 0 {
-				ctx.KvCacheClear()
+			if len(sess.prevTokens) == 0 {
+				ctx.KvCacheSeqRm(sess.seqID, 0, -1)
 			} else {
-				ctx.KvCacheSeqRm(0, len(prevTokens), -1)
+				ctx.KvCacheSeqRm(sess.seqID, len(sess.prevTokens), -1)
 			}
 		}
 		if kvWindow > 0 {
-			prevTokens = trimTokens(prevTokens, kvWindow)
+			sess.prevTokens = trimTokens(sess.prevTokens, kvWindow)
 		}
-		if !rawOut {
-			writer.Flush()
-			fmt.Fprintln(writer.writer)
+		if err := sessions.persist(sess); err != nil {
+			fmt.Fprintf(os.Stderr, "session persist failed: %v\n", err)
+		}
+		if err := sink.Finish(writer, rawOut); err != nil {
+			fmt.Fprintf(os.Stderr, "sink finish failed: %v\n", err)
 		}
-		fmt.Fprint(writer.writer, endMarker)
-		writer.Flush()
 		if !rawOut {
 			fmt.Fprintf(os.Stderr, "\ncompleted in %s\n", time.Since(start).Round(time.Millisecond))
 		}
@@ -470,7 +623,7 @@ func trimNewlines(s string) string {
 	return strings.TrimRight(s, "\r\n")
 }
 
-func runPrompt(prompt string, ctx *llama.Context, model *llama.Model, sampler *llama.SamplingContext, batch *llama.Batch, writer *streamWriter, maxTokens int, rawOut bool, stats *runStats, stateSavePath string, kvWindow int, metrics bool) error {
+func runPrompt(prompt string, ctx *llama.Context, model *llama.Model, sampler *llama.SamplingContext, baseParams llama.SamplingParams, batch *llama.Batch, writer tokenWriter, maxTokens int, rawOut bool, stats *runStats, stateSavePath string, kvWindow int, metrics bool, thresholdCfg *threshold.Config) error {
 	ctx.KvCacheClear()
 	sampler.Reset()
 
@@ -487,7 +640,7 @@ func runPrompt(prompt string, ctx *llama.Context, model *llama.Model, sampler *l
 			return ctx.StateSaveFile(stateSavePath, toks)
 		}
 	}
-	_, err = runTokens(toks, 0, 0, ctx, model, sampler, batch, writer, maxTokens, rawOut, stats, saveFn, kvWindow, metrics)
+	_, err = runTokens(toks, 0, 0, 0, ctx, model, sampler, batch, writer, maxTokens, rawOut, stats, saveFn, kvWindow, metrics, newThresholdRuntime(thresholdCfg, model, baseParams))
 	return err
 }
 
@@ -503,7 +656,7 @@ func tokenizePrompt(model *llama.Model, prompt string, noBos bool) ([]int, error
 	return toks, nil
 }
 
-func runTokens(toks []int, startPos int, posOffset int, ctx *llama.Context, model *llama.Model, sampler *llama.SamplingContext, batch *llama.Batch, writer *streamWriter, maxTokens int, rawOut bool, stats *runStats, stateSave func() error, kvWindow int, metrics bool) ([]int, error) {
+func runTokens(toks []int, startPos int, posOffset int, seqID int, ctx *llama.Context, model *llama.Model, sampler *llama.SamplingContext, batch *llama.Batch, writer tokenWriter, maxTokens int, rawOut bool, stats *runStats, stateSave func() error, kvWindow int, metrics bool, thresh *thresholdRuntime) ([]int, error) {
 	if len(toks) == 0 {
 		return nil, fmt.Errorf("empty tokens")
 	}
@@ -528,7 +681,7 @@ func runTokens(toks []int, startPos int, posOffset int, ctx *llama.Context, mode
 			idx := pos + i
 			absPos := posOffset + idx
 			logits := idx == len(toks)-1
-			batch.Add(toks[idx], nil, absPos, logits, 0)
+			batch.Add(toks[idx], nil, absPos, logits, seqID)
 		}
 		if err := ctx.Decode(batch); err != nil {
 			if errors.Is(err, llama.ErrKvCacheFull) {
@@ -550,17 +703,21 @@ func runTokens(toks []int, startPos int, posOffset int, ctx *llama.Context, mode
 	lastToken := toks[len(toks)-1]
 	curPos := posOffset + len(toks)
 	if !rawOut {
-		fmt.Fprintln(writer.writer, "nox:")
+		if err := writer.WriteString("nox:\n"); err != nil {
+			return nil, err
+		}
 	}
 
 	generated := make([]int, 0, maxTokens)
 	genStart := time.Now()
+	activeSampler := sampler
+	retemperLeft := 0
 	for i := 0; i < maxTokens; i++ {
 		if kvWindow > 0 && curPos >= kvWindow {
-			curPos = shiftKvCache(ctx, curPos, kvWindow)
+			curPos = shiftKvCache(ctx, curPos, kvWindow, seqID)
 		}
 		batch.Clear()
-		batch.Add(lastToken, nil, curPos, true, 0)
+		batch.Add(lastToken, nil, curPos, true, seqID)
 		if err := ctx.Decode(batch); err != nil {
 			if errors.Is(err, llama.ErrKvCacheFull) {
 				if kvWindow > 0 {
@@ -577,8 +734,18 @@ func runTokens(toks []int, startPos int, posOffset int, ctx *llama.Context, mode
 			max1, max2 = logitsTop2(ctx)
 		}
 
-		token := sampler.Sample(ctx, 0)
-		sampler.Accept(token, true)
+		usedSampler := activeSampler
+		token, nextSampler, stop, rejected, stopRule := sampleWithThreshold(ctx, thresh, activeSampler, &retemperLeft, curPos)
+		activeSampler = nextSampler
+		if stop {
+			if stats != nil {
+				stats.StopReason = stopRule
+			}
+			if rejected {
+				return generated, fmt.Errorf("%w: rule %s", threshold.ErrReject, stopRule)
+			}
+			break
+		}
 		if model.TokenIsEog(token) {
 			break
 		}
@@ -595,6 +762,17 @@ func runTokens(toks []int, startPos int, posOffset int, ctx *llama.Context, mode
 
 		lastToken = token
 		curPos++
+		// retemperLeft counts tokens drawn by the retempered sampler; the
+		// token whose rule switched samplers was drawn before the switch.
+		if activeSampler != sampler {
+			if activeSampler == usedSampler {
+				retemperLeft--
+			}
+			if retemperLeft <= 0 {
+				retemperLeft = 0
+				activeSampler = sampler
+			}
+		}
 	}
 	if err := writer.Flush(); err != nil {
 		return generated, err
@@ -628,7 +806,7 @@ func trimTokens(tokens []int, window int) []int {
 	return tokens[len(tokens)-window:]
 }
 
-func shiftKvCache(ctx *llama.Context, curPos int, window int) int {
+func shiftKvCache(ctx *llama.Context, curPos int, window int, seqID int) int {
 	if window <= 0 || curPos < window {
 		return curPos
 	}
@@ -639,8 +817,8 @@ func shiftKvCache(ctx *llama.Context, curPos int, window int) int {
 	if discard <= 0 || discard >= curPos {
 		return curPos
 	}
-	ctx.KvCacheSeqRm(0, 0, discard)
-	ctx.KvCacheSeqAdd(0, discard, curPos, -discard)
+	ctx.KvCacheSeqRm(seqID, 0, discard)
+	ctx.KvCacheSeqAdd(seqID, discard, curPos, -discard)
 	return curPos - discard
 }
 
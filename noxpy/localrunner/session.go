@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/llama"
+	"github.com/redis/go-redis/v9"
+)
+
+// SessionStore persists a conversation's token history (and an opaque
+// backend-specific blob) under a session id, so a long-running -serve
+// process can multiplex many conversations and survive restarts.
+type SessionStore interface {
+	Save(id string, tokens []int, blob []byte) error
+	Load(id string) ([]int, []byte, error)
+	Delete(id string) error
+}
+
+// sessionRecord is the on-disk / on-wire shape used by both backends.
+type sessionRecord struct {
+	Tokens []int  `json:"tokens"`
+	Blob   []byte `json:"blob,omitempty"`
+}
+
+// fileSessionStore is the generalisation of the original -state-save /
+// -state-load single-path behaviour: one JSON record per session id,
+// under a directory.
+type fileSessionStore struct {
+	dir string
+}
+
+func newFileSessionStore(dir string) (*fileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("session store: create %s: %w", dir, err)
+	}
+	return &fileSessionStore{dir: dir}, nil
+}
+
+func (f *fileSessionStore) path(id string) string {
+	return filepath.Join(f.dir, url.QueryEscape(id)+".json")
+}
+
+func (f *fileSessionStore) Save(id string, tokens []int, blob []byte) error {
+	data, err := json.Marshal(sessionRecord{Tokens: tokens, Blob: blob})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.path(id), data, 0o644)
+}
+
+func (f *fileSessionStore) Load(id string) ([]int, []byte, error) {
+	data, err := os.ReadFile(f.path(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	var rec sessionRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, nil, err
+	}
+	return rec.Tokens, rec.Blob, nil
+}
+
+func (f *fileSessionStore) Delete(id string) error {
+	err := os.Remove(f.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// redisSessionStore stores the same record as fileSessionStore, but as a
+// single key per session in Redis, so any noctics process pointed at the
+// same instance can pick a conversation back up.
+type redisSessionStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// newRedisSessionStore parses a redis://host:port/db?prefix=nox: URL (or
+// rediss:// for TLS). rediss:// gets a non-nil TLSConfig so it actually
+// connects over TLS instead of silently downgrading to plaintext the way a
+// bare redis.Options{} (with no TLSConfig set) would.
+func newRedisSessionStore(raw string) (*redisSessionStore, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("session store: parse %s: %w", raw, err)
+	}
+	db := 0
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		db, err = strconv.Atoi(path)
+		if err != nil {
+			return nil, fmt.Errorf("session store: invalid db %q: %w", path, err)
+		}
+	}
+	opts := &redis.Options{
+		Addr:     u.Host,
+		Password: passwordOf(u),
+		DB:       db,
+	}
+	if u.Scheme == "rediss" {
+		opts.TLSConfig = &tls.Config{}
+	}
+	client := redis.NewClient(opts)
+	return &redisSessionStore{client: client, prefix: u.Query().Get("prefix")}, nil
+}
+
+func passwordOf(u *url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	pw, _ := u.User.Password()
+	return pw
+}
+
+func (r *redisSessionStore) key(id string) string {
+	return r.prefix + id
+}
+
+func (r *redisSessionStore) Save(id string, tokens []int, blob []byte) error {
+	data, err := json.Marshal(sessionRecord{Tokens: tokens, Blob: blob})
+	if err != nil {
+		return err
+	}
+	return r.client.Set(context.Background(), r.key(id), data, 0).Err()
+}
+
+func (r *redisSessionStore) Load(id string) ([]int, []byte, error) {
+	data, err := r.client.Get(context.Background(), r.key(id)).Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	var rec sessionRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, nil, err
+	}
+	return rec.Tokens, rec.Blob, nil
+}
+
+func (r *redisSessionStore) Delete(id string) error {
+	return r.client.Del(context.Background(), r.key(id)).Err()
+}
+
+// newSessionStore builds a SessionStore from -state-store: a
+// "redis://host:port/db?prefix=nox:" URL selects the Redis backend,
+// anything else is treated as a directory for the file backend.
+func newSessionStore(raw string) (SessionStore, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(raw, "redis://") || strings.HasPrefix(raw, "rediss://") {
+		return newRedisSessionStore(raw)
+	}
+	return newFileSessionStore(raw)
+}
+
+// sessionState is the per-session slice of what used to be serveLoop's
+// process-wide prevTokens/cacheGenerated locals, plus the KV cache
+// sequence id this session owns for the lifetime of the process.
+type sessionState struct {
+	id             string
+	seqID          int
+	prevTokens     []int
+	cacheGenerated bool
+}
+
+// sessionTable multiplexes sessionStates by id, assigning each a distinct
+// KV cache sequence id (see batch.Add / KvCacheSeqRm / KvCacheSeqAdd) and,
+// if a SessionStore is configured, hydrating/persisting their token
+// history across restarts. The default session (id "") keeps sequence id
+// 0, matching the single-session behaviour -serve had before sessions
+// existed.
+//
+// Sequence ids are a bounded pool sized by -max-sessions (the same number
+// the context/batch were allocated with, see llama.NewContextParams /
+// llama.NewBatch in main()): once all maxSessions ids are handed out, the
+// least-recently-used session (never the default one) is evicted and its
+// seq id, and the KV cache it occupied, are reused for the new session.
+type sessionTable struct {
+	store                 SessionStore
+	ctx                   *llama.Context
+	maxSessions           int
+	cacheGeneratedDefault bool
+
+	byID    map[string]*sessionState
+	lru     []string
+	freeSeq []int
+	nextSeq int
+}
+
+func newSessionTable(ctx *llama.Context, store SessionStore, maxSessions int, cacheGeneratedDefault bool, initial *sessionState) *sessionTable {
+	if maxSessions < 1 {
+		maxSessions = 1
+	}
+	t := &sessionTable{
+		store:                 store,
+		ctx:                   ctx,
+		maxSessions:           maxSessions,
+		cacheGeneratedDefault: cacheGeneratedDefault,
+		byID:                  map[string]*sessionState{},
+	}
+	if initial == nil {
+		initial = &sessionState{cacheGenerated: cacheGeneratedDefault}
+	}
+	t.byID[initial.id] = initial
+	t.lru = append(t.lru, initial.id)
+	t.nextSeq = initial.seqID + 1
+	return t
+}
+
+// get returns the session for id, creating it (and hydrating it from the
+// store, if one is configured and the session isn't already known) on
+// first reference. A newly created session picks up -input-only the same
+// way the default one does, via cacheGeneratedDefault.
+func (t *sessionTable) get(id string) *sessionState {
+	if sess, ok := t.byID[id]; ok {
+		t.touch(id)
+		return sess
+	}
+	sess := &sessionState{id: id, seqID: t.acquireSeqID(), cacheGenerated: t.cacheGeneratedDefault}
+	if t.store != nil {
+		if tokens, _, err := t.store.Load(id); err == nil {
+			sess.prevTokens = tokens
+		}
+	}
+	t.byID[id] = sess
+	t.lru = append(t.lru, id)
+	return sess
+}
+
+// acquireSeqID hands out a seq id from the bounded pool, growing it up to
+// maxSessions and then evicting the least-recently-used session to reuse
+// its id once the pool is exhausted.
+func (t *sessionTable) acquireSeqID() int {
+	if n := len(t.freeSeq); n > 0 {
+		id := t.freeSeq[n-1]
+		t.freeSeq = t.freeSeq[:n-1]
+		return id
+	}
+	if t.nextSeq < t.maxSessions {
+		id := t.nextSeq
+		t.nextSeq++
+		return id
+	}
+	if seqID, ok := t.evictOldest(); ok {
+		return seqID
+	}
+	// Only the default session exists (maxSessions == 1): fall back to
+	// sharing its seq id, matching pre-session single-session behaviour.
+	return 0
+}
+
+// evictOldest drops the least-recently-used non-default session, persisting
+// it first and clearing the KV cache sequence it held so the id can be
+// reused without mixing histories.
+func (t *sessionTable) evictOldest() (int, bool) {
+	for i, id := range t.lru {
+		if id == "" {
+			continue
+		}
+		sess := t.byID[id]
+		if err := t.persist(sess); err != nil {
+			fmt.Fprintf(os.Stderr, "session evict: persist %s: %v\n", id, err)
+		}
+		if t.ctx != nil {
+			t.ctx.KvCacheSeqRm(sess.seqID, 0, -1)
+		}
+		delete(t.byID, id)
+		t.lru = append(t.lru[:i], t.lru[i+1:]...)
+		return sess.seqID, true
+	}
+	return 0, false
+}
+
+// touch moves id to the most-recently-used end of the LRU order.
+func (t *sessionTable) touch(id string) {
+	for i, v := range t.lru {
+		if v == id {
+			t.lru = append(t.lru[:i], t.lru[i+1:]...)
+			break
+		}
+	}
+	t.lru = append(t.lru, id)
+}
+
+// persist saves a session's token history to the store, if any is
+// configured. The blob persisted today is nil: the underlying
+// llama.Context state save/load API snapshots the whole context rather
+// than a single KV cache sequence, so there is no seq-scoped byte blob to
+// capture here yet. Token history alone is still enough to hydrate
+// keep-cache prefix matching across a restart.
+func (t *sessionTable) persist(sess *sessionState) error {
+	if t.store == nil {
+		return nil
+	}
+	return t.store.Save(sess.id, sess.prevTokens, nil)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFileSessionStoreRoundTrip(t *testing.T) {
+	store, err := newFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newFileSessionStore: %v", err)
+	}
+	tokens := []int{1, 2, 3}
+	blob := []byte("state")
+	if err := store.Save("sess-a", tokens, blob); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	gotTokens, gotBlob, err := store.Load("sess-a")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(gotTokens, tokens) || string(gotBlob) != string(blob) {
+		t.Fatalf("Load = (%v, %q), want (%v, %q)", gotTokens, gotBlob, tokens, blob)
+	}
+	if err := store.Delete("sess-a"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := store.Delete("sess-a"); err != nil {
+		t.Fatalf("Delete of an already-deleted session should be a no-op, got: %v", err)
+	}
+	if _, _, err := store.Load("sess-a"); err == nil {
+		t.Fatal("Load after Delete should fail")
+	}
+}
+
+// TestSessionRecordJSONRoundTrip exercises the wire contract both
+// fileSessionStore and redisSessionStore marshal/unmarshal through; a live
+// Redis instance isn't available to a unit test, but both backends share
+// this exact sessionRecord encoding.
+func TestSessionRecordJSONRoundTrip(t *testing.T) {
+	rec := sessionRecord{Tokens: []int{4, 5, 6}, Blob: []byte("blob")}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var got sessionRecord
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(got, rec) {
+		t.Fatalf("round trip = %+v, want %+v", got, rec)
+	}
+}
+
+func TestSessionTableAcquireSeqIDEvictsLRU(t *testing.T) {
+	table := newSessionTable(nil, nil, 2, true, nil)
+
+	a := table.get("a")
+	if a.seqID != 1 {
+		t.Fatalf("session a should get seq id 1 (seq 0 is the default session), got %d", a.seqID)
+	}
+
+	// The pool (size 2) is now full with "" and "a"; "b" must evict the
+	// least-recently-used non-default session ("a") and reuse its seq id.
+	b := table.get("b")
+	if b.seqID != a.seqID {
+		t.Fatalf("session b should reuse evicted session a's seq id %d, got %d", a.seqID, b.seqID)
+	}
+	if _, ok := table.byID["a"]; ok {
+		t.Fatal("evicted session a should no longer be tracked")
+	}
+	if _, ok := table.byID[""]; !ok {
+		t.Fatal("the default session should never be evicted")
+	}
+}
+
+func TestSessionTableTouchReordersLRU(t *testing.T) {
+	table := newSessionTable(nil, nil, 3, true, nil)
+	table.get("a")
+	table.get("b")
+
+	// Touching "a" again should make "b" the new least-recently-used, so
+	// the next eviction (pool size 3: "", "a", "b" already fills it) drops
+	// "b" instead of "a".
+	table.get("a")
+	table.get("c")
+
+	if _, ok := table.byID["b"]; ok {
+		t.Fatal("\"b\" should have been evicted as the least-recently-used session")
+	}
+	if _, ok := table.byID["a"]; !ok {
+		t.Fatal("\"a\" should have survived eviction after being touched")
+	}
+}
+
+func TestSessionTableCacheGeneratedDefaultPropagates(t *testing.T) {
+	table := newSessionTable(nil, nil, 4, false, nil)
+	sess := table.get("new-session")
+	if sess.cacheGenerated {
+		t.Fatal("new sessions should inherit cacheGeneratedDefault (false here), not hardcode true")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ollama/ollama/llama"
+
+	"github.com/Rei-ath/noctics/pkg/threshold"
+)
+
+// thresholdRuntime bundles what runTokens needs to drive a
+// threshold.Controller against live generation. It is rebuilt fresh for
+// every runTokens call (a ring buffer of margins resetting per completion
+// is the correct behaviour, not a limitation) from the shared *threshold.Config
+// loaded once in main.
+//
+// "retemper" has no mid-stream Temp setter on llama.SamplingContext, so it
+// is implemented by reallocating a new sampler from baseParams with Temp
+// scaled by the rule's factor; model is needed for that reallocation.
+type thresholdRuntime struct {
+	controller *threshold.Controller
+	model      *llama.Model
+	baseParams llama.SamplingParams
+	topK       int
+}
+
+func newThresholdRuntime(cfg *threshold.Config, model *llama.Model, baseParams llama.SamplingParams) *thresholdRuntime {
+	if cfg == nil {
+		return nil
+	}
+	return &thresholdRuntime{
+		controller: threshold.NewController(*cfg),
+		model:      model,
+		baseParams: baseParams,
+		topK:       cfg.TopK,
+	}
+}
+
+// logitsTopK returns the k largest logits from the last decode, generalising
+// logitsTop2 for threshold.Entropy.
+func logitsTopK(ctx *llama.Context, k int) []float32 {
+	logits := ctx.GetLogitsIth(-1)
+	if len(logits) == 0 || k <= 0 {
+		return nil
+	}
+	if k > len(logits) {
+		k = len(logits)
+	}
+	top := append([]float32(nil), logits...)
+	// Partial selection sort: k is small (tens), len(logits) is the vocab
+	// size, so this is cheap relative to the decode it follows.
+	for i := 0; i < k; i++ {
+		maxIdx := i
+		for j := i + 1; j < len(top); j++ {
+			if top[j] > top[maxIdx] {
+				maxIdx = j
+			}
+		}
+		top[i], top[maxIdx] = top[maxIdx], top[i]
+	}
+	return top[:k]
+}
+
+// sampleWithThreshold samples one token, applying thresh's rules (if any)
+// along the way. It returns the accepted token, the active sampler to use
+// for subsequent tokens (changed by "retemper"), and whether generation
+// should stop (with the firing rule's name and whether it was a reject).
+//
+// thresh.controller.Observe is called exactly once per curPos (one token
+// position), not once per draw attempt: the margin/entropy come from this
+// position's decode and don't change across "resample" re-draws of the
+// same logits, so re-observing them would push a thrown-away draw into the
+// ring buffer/ema and let it consume streak/cooldown state meant to count
+// actual generated tokens.
+func sampleWithThreshold(ctx *llama.Context, thresh *thresholdRuntime, active *llama.SamplingContext, retemperLeft *int, curPos int) (token int, nextActive *llama.SamplingContext, stop bool, rejected bool, stopRule string) {
+	nextActive = active
+	const maxResamples = 4
+
+	token = active.Sample(ctx, 0)
+	active.Accept(token, true)
+	if thresh == nil {
+		return token, nextActive, false, false, ""
+	}
+
+	max1, max2 := logitsTop2(ctx)
+	margin := float64(max1 - max2)
+	entropy := threshold.Entropy(logitsTopK(ctx, thresh.topK))
+
+	resample := false
+	for _, d := range thresh.controller.Observe(margin, entropy) {
+		fmt.Fprintf(os.Stderr, "%srule|%s|%s|pos=%d\n", metricsPrefix, d.Rule, d.Action, curPos)
+		switch d.Action {
+		case threshold.ActionStop:
+			return token, nextActive, true, false, d.Rule
+		case threshold.ActionReject:
+			return token, nextActive, true, true, d.Rule
+		case threshold.ActionRetemper:
+			params := thresh.baseParams
+			params.Temp *= float32(d.Factor)
+			if ns, err := llama.NewSamplingContext(thresh.model, params); err == nil {
+				nextActive = ns
+				*retemperLeft = d.For
+			}
+		case threshold.ActionResample:
+			resample = true
+		}
+	}
+	if !resample {
+		return token, nextActive, false, false, ""
+	}
+
+	// Re-draw up to maxResamples-1 more times from the (possibly
+	// retempered) sampler. These re-draws share the decision already made
+	// above; they don't call Observe again.
+	for attempt := 1; attempt < maxResamples; attempt++ {
+		active = nextActive
+		// Re-drawing without an Unaccept means the discarded token still
+		// nudges the repetition penalty; llama.SamplingContext exposes no
+		// way to undo Accept, so this is an accepted, documented tradeoff.
+		token = active.Sample(ctx, 0)
+		active.Accept(token, true)
+	}
+	return token, nextActive, false, false, ""
+}
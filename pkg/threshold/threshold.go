@@ -0,0 +1,273 @@
+// Package threshold implements the confidence-threshold generation
+// controller driven by logit margin: a ring buffer of recent sampling
+// margins/entropy is evaluated against a set of declarative rules after
+// every generated token, and rules that hold can steer generation (stop
+// early, retemper, resample, or reject) without the caller babysitting
+// temperature by hand.
+package threshold
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ErrReject is returned (wrapped) by a generation loop when a rule's
+// action is "reject": the caller should treat generation as failed.
+var ErrReject = errors.New("threshold: reject action fired")
+
+// Metric is the signal a Rule compares against Value.
+type Metric string
+
+const (
+	MetricMargin Metric = "margin"
+	// MetricEMAMargin is an exponential moving average of margin; see Config.Alpha.
+	MetricEMAMargin Metric = "ema_margin"
+	MetricEntropy   Metric = "entropy"
+	// MetricWindowAvgMargin is the plain average of the last Window margins
+	// (the ring buffer Observe maintains), as opposed to ema_margin's
+	// exponential weighting.
+	MetricWindowAvgMargin Metric = "window_avg_margin"
+)
+
+// Op is the comparison a Rule applies between the observed metric and
+// Value.
+type Op string
+
+const (
+	OpLess           Op = "<"
+	OpGreater        Op = ">"
+	OpLessOrEqual    Op = "<="
+	OpGreaterOrEqual Op = ">="
+)
+
+// Action is what a Rule does once it has held for Consecutive tokens in a
+// row.
+type Action string
+
+const (
+	ActionStop     Action = "stop"
+	ActionRetemper Action = "retemper"
+	ActionResample Action = "resample"
+	ActionReject   Action = "reject"
+)
+
+// Rule is one declarative entry of a -threshold-rules TOML file, as a
+// [[rule]] array-of-tables element.
+type Rule struct {
+	Name        string  `toml:"name"`
+	Metric      Metric  `toml:"metric"`
+	Op          Op      `toml:"op"`
+	Value       float64 `toml:"value"`
+	Consecutive int     `toml:"consecutive"`
+	Cooldown    int     `toml:"cooldown"`
+	Action      Action  `toml:"action"`
+	// Factor is the temperature multiplier for action "retemper".
+	Factor float64 `toml:"factor"`
+	// For is how many generated tokens an action's effect lasts, used by
+	// "retemper" (number of tokens sampled at the adjusted temperature).
+	For int `toml:"for"`
+}
+
+// Config is the decoded form of a -threshold-rules file.
+type Config struct {
+	// Window is W, the ring buffer size of recent margins. Default 16.
+	Window int `toml:"window"`
+	// Alpha is the smoothing factor for ema_margin: ema = alpha*margin +
+	// (1-alpha)*ema_prev. Default 0.3.
+	Alpha float64 `toml:"alpha"`
+	// TopK bounds the softmax used to compute entropy. Default 40.
+	TopK  int    `toml:"top_k"`
+	Rules []Rule `toml:"rule"`
+}
+
+// LoadConfig decodes a -threshold-rules TOML file and fills in defaults
+// for any zero-valued Window/Alpha/TopK.
+func LoadConfig(path string) (*Config, error) {
+	cfg := Config{Window: 16, Alpha: 0.3, TopK: 40}
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return nil, fmt.Errorf("threshold: decode %s: %w", path, err)
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 16
+	}
+	if cfg.Alpha <= 0 {
+		cfg.Alpha = 0.3
+	}
+	if cfg.TopK <= 0 {
+		cfg.TopK = 40
+	}
+	for i, r := range cfg.Rules {
+		if r.Name == "" {
+			cfg.Rules[i].Name = fmt.Sprintf("rule%d", i)
+		}
+	}
+	return &cfg, nil
+}
+
+// Decision is what a Controller asks the caller to do after a rule fires.
+type Decision struct {
+	Rule   string
+	Action Action
+	Factor float64
+	For    int
+}
+
+// Controller holds the ring buffer, per-rule streak/cooldown counters and
+// running ema_margin for one generation stream (one runTokens call). It is
+// not safe for concurrent use.
+type Controller struct {
+	cfg Config
+
+	margins []float64
+	pos     int
+
+	emaMargin    float64
+	emaMarginSet bool
+
+	streak   []int
+	cooldown []int
+}
+
+// NewController returns a Controller for the given rule set. A nil/zero
+// Config yields a Controller whose Observe never fires anything.
+func NewController(cfg Config) *Controller {
+	return &Controller{
+		cfg:      cfg,
+		margins:  make([]float64, 0, cfg.Window),
+		streak:   make([]int, len(cfg.Rules)),
+		cooldown: make([]int, len(cfg.Rules)),
+	}
+}
+
+// Observe records the margin/entropy for one generated token and returns
+// every rule that fired as a result, in rule-declaration order.
+func (c *Controller) Observe(margin float64, entropy float64) []Decision {
+	c.pushMargin(margin)
+	if !c.emaMarginSet {
+		c.emaMargin = margin
+		c.emaMarginSet = true
+	} else {
+		c.emaMargin = c.cfg.Alpha*margin + (1-c.cfg.Alpha)*c.emaMargin
+	}
+
+	var fired []Decision
+	for i, rule := range c.cfg.Rules {
+		if c.cooldown[i] > 0 {
+			c.cooldown[i]--
+			c.streak[i] = 0
+			continue
+		}
+		value, ok := c.metricValue(rule.Metric, margin, entropy)
+		if !ok || !compare(rule.Op, value, rule.Value) {
+			c.streak[i] = 0
+			continue
+		}
+		c.streak[i]++
+		if c.streak[i] < maxInt(rule.Consecutive, 1) {
+			continue
+		}
+		c.streak[i] = 0
+		c.cooldown[i] = rule.Cooldown
+		fired = append(fired, Decision{Rule: rule.Name, Action: rule.Action, Factor: rule.Factor, For: rule.For})
+	}
+	return fired
+}
+
+func (c *Controller) metricValue(metric Metric, margin, entropy float64) (float64, bool) {
+	switch metric {
+	case MetricMargin:
+		return margin, true
+	case MetricEMAMargin:
+		return c.emaMargin, true
+	case MetricEntropy:
+		return entropy, true
+	case MetricWindowAvgMargin:
+		return c.windowAvgMargin(), true
+	default:
+		return 0, false
+	}
+}
+
+// windowAvgMargin returns the plain average of the margins currently held in
+// the ring buffer (up to the last Window tokens; fewer while it's still
+// filling).
+func (c *Controller) windowAvgMargin() float64 {
+	if len(c.margins) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, m := range c.margins {
+		sum += m
+	}
+	return sum / float64(len(c.margins))
+}
+
+func (c *Controller) pushMargin(margin float64) {
+	window := c.cfg.Window
+	if window <= 0 {
+		return
+	}
+	if len(c.margins) < window {
+		c.margins = append(c.margins, margin)
+		return
+	}
+	c.margins[c.pos] = margin
+	c.pos = (c.pos + 1) % window
+}
+
+func compare(op Op, value, threshold float64) bool {
+	switch op {
+	case OpLess:
+		return value < threshold
+	case OpGreater:
+		return value > threshold
+	case OpLessOrEqual:
+		return value <= threshold
+	case OpGreaterOrEqual:
+		return value >= threshold
+	default:
+		return false
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Entropy returns the Shannon entropy (nats) of a softmax over the given
+// top-K logits.
+func Entropy(topK []float32) float64 {
+	if len(topK) == 0 {
+		return 0
+	}
+	max := topK[0]
+	for _, v := range topK {
+		if v > max {
+			max = v
+		}
+	}
+	var sum float64
+	probs := make([]float64, len(topK))
+	for i, v := range topK {
+		p := math.Exp(float64(v - max))
+		probs[i] = p
+		sum += p
+	}
+	if sum == 0 {
+		return 0
+	}
+	var entropy float64
+	for _, p := range probs {
+		p /= sum
+		if p > 0 {
+			entropy -= p * math.Log(p)
+		}
+	}
+	return entropy
+}
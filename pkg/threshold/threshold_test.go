@@ -0,0 +1,119 @@
+package threshold
+
+import "testing"
+
+func TestControllerConsecutiveAndCooldown(t *testing.T) {
+	cfg := Config{
+		Window: 4,
+		Alpha:  0.5,
+		TopK:   10,
+		Rules: []Rule{
+			{Name: "low-margin", Metric: MetricMargin, Op: OpLess, Value: 1.0, Consecutive: 2, Cooldown: 1, Action: ActionStop},
+		},
+	}
+	c := NewController(cfg)
+
+	if got := c.Observe(0.5, 0); len(got) != 0 {
+		t.Fatalf("first below-threshold observation should not fire yet (consecutive=2), got %v", got)
+	}
+	got := c.Observe(0.5, 0)
+	if len(got) != 1 || got[0].Rule != "low-margin" || got[0].Action != ActionStop {
+		t.Fatalf("second consecutive below-threshold observation should fire, got %v", got)
+	}
+
+	// Cooldown of 1 should suppress the very next observation even though
+	// it also satisfies the rule.
+	if got := c.Observe(0.5, 0); len(got) != 0 {
+		t.Fatalf("rule should be in cooldown, got %v", got)
+	}
+	// Cooldown has now elapsed, but the streak was reset while cooling
+	// down, so a single observation should not refire immediately.
+	if got := c.Observe(0.5, 0); len(got) != 0 {
+		t.Fatalf("streak should have to rebuild after cooldown, got %v", got)
+	}
+	got = c.Observe(0.5, 0)
+	if len(got) != 1 {
+		t.Fatalf("rule should fire again once the streak rebuilds, got %v", got)
+	}
+}
+
+func TestControllerEMAMargin(t *testing.T) {
+	cfg := Config{
+		Window: 4,
+		Alpha:  0.5,
+		TopK:   10,
+		Rules: []Rule{
+			{Name: "ema-drop", Metric: MetricEMAMargin, Op: OpLess, Value: 0.3, Consecutive: 1, Action: ActionRetemper, Factor: 1.5, For: 3},
+		},
+	}
+	c := NewController(cfg)
+
+	// ema starts at the first margin (1.0), so it should not fire yet.
+	if got := c.Observe(1.0, 0); len(got) != 0 {
+		t.Fatalf("ema should seed at first margin, got %v", got)
+	}
+	// ema = 0.5*0.0 + 0.5*1.0 = 0.5, still above threshold.
+	if got := c.Observe(0.0, 0); len(got) != 0 {
+		t.Fatalf("ema should still be above threshold, got %v", got)
+	}
+	// ema = 0.5*0.0 + 0.5*0.5 = 0.25, below threshold.
+	got := c.Observe(0.0, 0)
+	if len(got) != 1 || got[0].Action != ActionRetemper || got[0].Factor != 1.5 || got[0].For != 3 {
+		t.Fatalf("expected retemper decision once ema drops below threshold, got %v", got)
+	}
+}
+
+func TestControllerWindowAvgMargin(t *testing.T) {
+	cfg := Config{
+		Window: 3,
+		Alpha:  0.3,
+		TopK:   10,
+		Rules: []Rule{
+			{Name: "avg-drop", Metric: MetricWindowAvgMargin, Op: OpLess, Value: 1.0, Consecutive: 1, Action: ActionStop},
+		},
+	}
+	c := NewController(cfg)
+
+	c.Observe(2.0, 0)
+	c.Observe(2.0, 0)
+	// Buffer now holds [2.0, 2.0], average 2.0: should not fire.
+	if got := c.Observe(2.0, 0); len(got) != 0 {
+		t.Fatalf("window average should still be above threshold, got %v", got)
+	}
+	// Push enough low margins that the window (size 3) evicts the 2.0s.
+	c.Observe(0.0, 0)
+	c.Observe(0.0, 0)
+	got := c.Observe(0.0, 0)
+	if len(got) != 1 {
+		t.Fatalf("window average should have dropped below threshold once old margins scroll out, got %v", got)
+	}
+}
+
+func TestControllerUnknownMetricNeverFires(t *testing.T) {
+	cfg := Config{
+		Window: 4,
+		Alpha:  0.3,
+		TopK:   10,
+		Rules: []Rule{
+			{Name: "bogus", Metric: Metric("nonsense"), Op: OpLess, Value: 100, Consecutive: 1, Action: ActionStop},
+		},
+	}
+	c := NewController(cfg)
+	if got := c.Observe(0, 0); len(got) != 0 {
+		t.Fatalf("unknown metric should never fire, got %v", got)
+	}
+}
+
+func TestEntropyUniformIsMax(t *testing.T) {
+	uniform := []float32{1, 1, 1, 1}
+	peaked := []float32{10, 0, 0, 0}
+	if e := Entropy(uniform); e <= Entropy(peaked) {
+		t.Fatalf("uniform logits should have higher entropy than a peaked distribution, got uniform=%.4f peaked=%.4f", e, Entropy(peaked))
+	}
+}
+
+func TestEntropyEmpty(t *testing.T) {
+	if e := Entropy(nil); e != 0 {
+		t.Fatalf("entropy of no logits should be 0, got %v", e)
+	}
+}